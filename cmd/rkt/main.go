@@ -0,0 +1,122 @@
+// Command rkt is the stage0 entry point: it parses `rkt run` flags into a
+// stage0.Config, calls stage0.Setup to prepare the container filesystem,
+// then stage0.Run to pivot/exec into it.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/coreos-inc/rkt/fetch"
+	"github.com/coreos-inc/rkt/sign"
+	"github.com/coreos-inc/rkt/stage0"
+	"github.com/coreos-inc/rkt/store"
+	"github.com/coreos-inc/rkt/volumes"
+)
+
+var (
+	rktDir             = flag.String("dir", "", "rkt data directory (default: a temporary directory)")
+	stage1Init         = flag.String("stage1-init", "", "path to the stage1 init binary (default: the binary's embedded default, if any)")
+	stage1Rootfs       = flag.String("stage1-rootfs", "", "path to the stage1 rootfs tarball (default: the binary's embedded default, if any)")
+	keyring            = flag.String("keyring", "", "path to the trusted OpenPGP keyring used to verify image signatures")
+	insecureSkipVerify = flag.Bool("insecure-skip-verify", false, "disable image signature verification for images with no --signature")
+	debug              = flag.Bool("debug", false, "enable debug output")
+)
+
+// signatureFlag collects repeated -signature=image=path.asc flags into a
+// map from image string to detached signature path.
+type signatureFlag map[string]string
+
+func (s signatureFlag) String() string {
+	var parts []string
+	for img, path := range s {
+		parts = append(parts, img+"="+path)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (s signatureFlag) Set(value string) error {
+	img, path, ok := cut(value, "=")
+	if !ok {
+		return fmt.Errorf("signature must be of the form image=path.asc, got %q", value)
+	}
+	s[img] = path
+	return nil
+}
+
+func cut(s, sep string) (before, after string, found bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// volumeFlag collects repeated -volume=... flags, parsing each with
+// volumes.ParseVolumeSpec as it's seen.
+type volumeFlag []volumes.VolumeSpec
+
+func (v *volumeFlag) String() string {
+	return fmt.Sprintf("%v", []volumes.VolumeSpec(*v))
+}
+
+func (v *volumeFlag) Set(value string) error {
+	vs, err := volumes.ParseVolumeSpec(value)
+	if err != nil {
+		return err
+	}
+	*v = append(*v, *vs)
+	return nil
+}
+
+func main() {
+	signatures := signatureFlag{}
+	var vols volumeFlag
+	flag.Var(signatures, "signature", "detached signature for an image, as image=path.asc (repeatable)")
+	flag.Var(&vols, "volume", "volume spec: name,kind=host,source=/path,readOnly=false,fulfills=app:mnt (repeatable)")
+	flag.Parse()
+
+	images := flag.Args()
+	if len(images) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: rkt [flags] image [image...]")
+		os.Exit(1)
+	}
+
+	dir := *rktDir
+	storeDir := filepath.Join(os.TempDir(), "rkt", "cas")
+	if dir != "" {
+		storeDir = filepath.Join(dir, "cas")
+	}
+	st, err := store.New(storeDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rkt: %v\n", err)
+		os.Exit(1)
+	}
+
+	keystore := &sign.Keystore{TrustedKeyring: *keyring}
+	cfg := stage0.Config{
+		Store:              st,
+		Finder:             &fetch.Finder{Store: st, Fetcher: &fetch.Fetcher{Store: st, Keystore: keystore}},
+		Keystore:           keystore,
+		Signatures:         signatures,
+		InsecureSkipVerify: *insecureSkipVerify,
+		RktDir:             dir,
+		Stage1Init:         *stage1Init,
+		Stage1Rootfs:       *stage1Rootfs,
+		Debug:              *debug,
+		Images:             images,
+		Volumes:            vols,
+	}
+
+	containerDir, err := stage0.Setup(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rkt: %v\n", err)
+		os.Exit(1)
+	}
+	if err := stage0.Run(containerDir, *debug); err != nil {
+		fmt.Fprintf(os.Stderr, "rkt: %v\n", err)
+		os.Exit(1)
+	}
+}
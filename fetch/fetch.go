@@ -0,0 +1,287 @@
+// Package fetch resolves the image strings a user passes to `rkt run`
+// (local hashes, filesystem paths, URLs, or bare app-container names) down
+// to a verified hash in the local store, fetching the image over the
+// network first if necessary.
+package fetch
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/containers/standard/schema/types"
+	"github.com/coreos-inc/rkt/image"
+	"github.com/coreos-inc/rkt/imgtype"
+	"github.com/coreos-inc/rkt/sign"
+	"github.com/coreos-inc/rkt/store"
+)
+
+// ImageType classifies how an image argument given to `rkt run` should be
+// resolved.
+type ImageType int
+
+const (
+	TypeHash ImageType = iota
+	TypeURL
+	TypePath
+	TypeName
+)
+
+// DistFromImageString classifies img as a hash, a URL, a filesystem path,
+// or a bare app-container name (to be resolved via meta-tag discovery).
+func DistFromImageString(img string) ImageType {
+	if _, err := types.NewHash(img); err == nil {
+		return TypeHash
+	}
+	// types.NewHash only accepts a full-length digest, but a user is
+	// allowed to pass an abbreviated hash prefix (e.g. from `rkt list`
+	// output) and let the store resolve it. Recognize anything that
+	// looks like a hex digest prefix here too, and let FindImage sort
+	// out resolving it against the store.
+	if isHexPrefix(img) {
+		return TypeHash
+	}
+	if u, err := url.Parse(img); err == nil && u.Scheme != "" {
+		return TypeURL
+	}
+	if _, err := os.Stat(img); err == nil {
+		return TypePath
+	}
+	return TypeName
+}
+
+// isHexPrefix reports whether s is a plausible abbreviated hex digest: a
+// non-empty run of hex digits no longer than a full SHA-256 digest.
+func isHexPrefix(s string) bool {
+	if s == "" || len(s) > sha256.Size*2 {
+		return false
+	}
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+		case r >= 'a' && r <= 'f':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Finder resolves an image string to the hash of a verified image in
+// Store, fetching it with Fetcher first if it isn't already there.
+type Finder struct {
+	Store   *store.Store
+	Fetcher *Fetcher
+}
+
+// FindImage resolves img (optionally accompanied by a detached signature
+// at ascPath) to the hash of an image present in f.Store.
+func (f *Finder) FindImage(img, ascPath string) (*types.Hash, error) {
+	if DistFromImageString(img) == TypeHash {
+		// img may be a full digest or an abbreviated prefix of one;
+		// ResolveKey accepts either and rejects ambiguous prefixes,
+		// so just hand it img directly rather than requiring
+		// types.NewHash(img) to succeed first.
+		key, err := f.Store.ResolveKey(img)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving image %q in store: %v", img, err)
+		}
+		full, err := types.NewHash(key)
+		if err != nil {
+			return nil, err
+		}
+		return &full, nil
+	}
+
+	h, err := f.Fetcher.FetchImage(img, ascPath)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching image %q: %v", img, err)
+	}
+	return &h, nil
+}
+
+// Fetcher downloads images over HTTPS and stores them in Store, returning
+// the hash they were stored under. If a detached signature is supplied
+// to FetchImage, it is checked against Keystore's trusted keys as part of
+// the same download, and FetchImage fails if verification fails; the
+// bytes are already in Store by then, since the check completes only
+// once the whole stream has been read. Keystore must be set for those
+// calls to succeed.
+type Fetcher struct {
+	Store    *store.Store
+	Keystore *sign.Keystore
+}
+
+// FetchImage resolves img to a URL (classifying it as a URL, a local
+// path, or a bare app-container name to be discovered), downloads it,
+// verifies it against the detached signature at ascPath (if any), and
+// stores it in f.Store keyed by its computed SHA-256 hash. Network
+// fetches are refused over anything but HTTPS.
+func (f *Fetcher) FetchImage(img, ascPath string) (types.Hash, error) {
+	var u string
+
+	switch DistFromImageString(img) {
+	case TypePath:
+		if it, err := imgtype.Detect(img); err == nil && it != imgtype.TypeACI {
+			rc, _, err := imgtype.Convert(img)
+			if err != nil {
+				return types.Hash{}, fmt.Errorf("error converting OCI image %q: %v", img, err)
+			}
+			defer rc.Close()
+			return f.verifyAndStore(rc, ascPath)
+		}
+		fh, err := os.Open(img)
+		if err != nil {
+			return types.Hash{}, fmt.Errorf("error opening %q: %v", img, err)
+		}
+		defer fh.Close()
+		return f.verifyAndStore(fh, ascPath)
+	case TypeURL:
+		if !strings.HasPrefix(img, "https://") {
+			return types.Hash{}, fmt.Errorf("refusing to fetch %q over a non-HTTPS scheme", img)
+		}
+		u = img
+	case TypeName:
+		discovered, err := discoverACIEndpoint(img)
+		if err != nil {
+			return types.Hash{}, fmt.Errorf("error discovering %q: %v", img, err)
+		}
+		if !strings.HasPrefix(discovered, "https://") {
+			return types.Hash{}, fmt.Errorf("refusing to fetch discovered endpoint %q over a non-HTTPS scheme", discovered)
+		}
+		u = discovered
+	default:
+		return types.Hash{}, fmt.Errorf("don't know how to fetch %q", img)
+	}
+
+	res, err := http.Get(u)
+	if err != nil {
+		return types.Hash{}, fmt.Errorf("error fetching %q: %v", u, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return types.Hash{}, fmt.Errorf("bad HTTP status code from %q: %d", u, res.StatusCode)
+	}
+
+	return f.verifyAndStore(res.Body, ascPath)
+}
+
+// verifyAndStore stores r, checking it against the detached signature at
+// ascPath as it's streamed in if ascPath is non-empty. Verification
+// failure (including the image's bytes already having been written to
+// Store, since storeStream must read the whole stream to hash it) causes
+// the call to fail; stage0.setupImage is the last line of defense either
+// way; this lets fetching itself reject a bad signature up front too.
+func (f *Fetcher) verifyAndStore(r io.Reader, ascPath string) (types.Hash, error) {
+	if ascPath == "" {
+		return f.storeStream(r)
+	}
+	if f.Keystore == nil {
+		return types.Hash{}, fmt.Errorf("no keystore configured to verify signature %q", ascPath)
+	}
+
+	sigFh, err := os.Open(ascPath)
+	if err != nil {
+		return types.Hash{}, fmt.Errorf("error opening signature: %v", err)
+	}
+	defer sigFh.Close()
+
+	vr := sign.NewVerifyingReader(r, sigFh, f.Keystore)
+	defer vr.Close()
+
+	h, err := f.storeStream(vr)
+	if err != nil {
+		return types.Hash{}, err
+	}
+	if err := vr.Verified(); err != nil {
+		return types.Hash{}, fmt.Errorf("signature verification failed: %v", err)
+	}
+	return h, nil
+}
+
+// storeStream copies r into a temporary file, then moves that file into
+// f.Store keyed by the SHA-256 digest of its decompressed tar content.
+// The key must match what stage0.setupImage recomputes when it later
+// reads the image back out of the store and re-verifies it, and that
+// digest is taken over the decompressed stream (gzip/bzip2-compressed
+// ACIs are the common case), so the raw, as-received bytes can't be
+// hashed directly here.
+func (f *Fetcher) storeStream(r io.Reader) (types.Hash, error) {
+	tmp, err := ioutil.TempFile("", "rkt-fetch")
+	if err != nil {
+		return types.Hash{}, fmt.Errorf("error creating temporary file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		return types.Hash{}, fmt.Errorf("error downloading image: %v", err)
+	}
+	if _, err := tmp.Seek(0, 0); err != nil {
+		return types.Hash{}, fmt.Errorf("error rewinding downloaded image: %v", err)
+	}
+
+	cr, err := image.NewCompressedTarReader(tmp)
+	if err != nil {
+		return types.Hash{}, fmt.Errorf("error reading downloaded image: %v", err)
+	}
+	sum := sha256.New()
+	if _, err := io.Copy(sum, cr); err != nil {
+		return types.Hash{}, fmt.Errorf("error hashing downloaded image: %v", err)
+	}
+
+	key := fmt.Sprintf("%x", sum.Sum(nil))
+	h, err := types.NewHash(key)
+	if err != nil {
+		return types.Hash{}, err
+	}
+
+	if _, err := tmp.Seek(0, 0); err != nil {
+		return types.Hash{}, fmt.Errorf("error rewinding downloaded image: %v", err)
+	}
+	if err := f.Store.WriteStream(key, tmp); err != nil {
+		return types.Hash{}, err
+	}
+
+	return h, nil
+}
+
+// acDiscoveryMeta matches the <meta name="ac-discovery" content="prefix
+// template"> tags used for app-container discovery, analogous to Go's
+// "go-import" meta tag convention.
+var acDiscoveryMeta = regexp.MustCompile(`<meta\s+name="ac-discovery"\s+content="([^\s]+)\s+([^"]+)"\s*/?>`)
+
+// discoverACIEndpoint turns a bare app name such as
+// "example.com/ourapp-1.0.0" into a downloadable ACI URL by fetching
+// https://<host>/<path>?ac-discovery=1 and reading its ac-discovery meta
+// tag.
+func discoverACIEndpoint(name string) (string, error) {
+	res, err := http.Get(fmt.Sprintf("https://%s?ac-discovery=1", name))
+	if err != nil {
+		return "", fmt.Errorf("error performing discovery: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("bad HTTP status code performing discovery: %d", res.StatusCode)
+	}
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading discovery response: %v", err)
+	}
+
+	m := acDiscoveryMeta.FindSubmatch(b)
+	if m == nil {
+		return "", fmt.Errorf("no ac-discovery meta tag found for %q", name)
+	}
+	if string(m[1]) != name && !strings.HasPrefix(name, string(m[1])) {
+		return "", fmt.Errorf("ac-discovery prefix %q does not match %q", m[1], name)
+	}
+	return strings.Replace(string(m[2]), "{name}", name, 1), nil
+}
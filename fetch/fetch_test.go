@@ -0,0 +1,48 @@
+package fetch
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDistFromImageString(t *testing.T) {
+	fullHash := "e" + strings.Repeat("a", 63)
+
+	cases := []struct {
+		img  string
+		want ImageType
+	}{
+		{fullHash, TypeHash},
+		{fullHash[:12], TypeHash},
+		{"abc123", TypeHash},
+		{"https://example.com/foo-1.0.0.aci", TypeURL},
+		{"example.com/ourapp-1.0.0", TypeName},
+		{"not-hex-!!!", TypeName},
+	}
+
+	for _, c := range cases {
+		if got := DistFromImageString(c.img); got != c.want {
+			t.Errorf("DistFromImageString(%q) = %v, want %v", c.img, got, c.want)
+		}
+	}
+}
+
+func TestIsHexPrefix(t *testing.T) {
+	cases := []struct {
+		s    string
+		want bool
+	}{
+		{"", false},
+		{"deadbeef", true},
+		{"DEADBEEF", false},
+		{"ghij", false},
+		{strings.Repeat("a", 64), true},
+		{strings.Repeat("a", 65), false},
+	}
+
+	for _, c := range cases {
+		if got := isHexPrefix(c.s); got != c.want {
+			t.Errorf("isHexPrefix(%q) = %v, want %v", c.s, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+// Package image provides helpers for introspecting app container images
+// (ACI/TAF tarballs) without fully extracting them to disk.
+package image
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/containers/standard/schema"
+)
+
+// manifestEntryName is the name of the app manifest entry within an
+// image's tar stream; see rkt.AppManifestPath for the on-disk equivalent
+// once an image has been extracted.
+const manifestEntryName = "manifest"
+
+// NewCompressedTarReader sniffs the magic bytes at the start of r and
+// returns a reader that transparently decompresses it. gzip and bzip2
+// are decompressed; xz is recognized by its magic bytes but not
+// decompressed, and returns an error. Anything else is assumed to already
+// be a plain tar stream and is returned unmodified.
+func NewCompressedTarReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(6)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("error sniffing image compression: %v", err)
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return bzip2.NewReader(br), nil
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return nil, fmt.Errorf("xz-compressed images are not yet supported")
+	default:
+		return br, nil
+	}
+}
+
+// ManifestFromImage walks the tar entries of rs, which must be positioned
+// at the start of an (optionally compressed) image tarball, and returns
+// the app manifest without extracting anything else. The caller is
+// responsible for seeking rs back to the start before using it again,
+// e.g. to actually extract the rootfs.
+func ManifestFromImage(rs io.ReadSeeker) (*schema.AppManifest, error) {
+	cr, err := NewCompressedTarReader(rs)
+	if err != nil {
+		return nil, err
+	}
+
+	tr := tar.NewReader(cr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no manifest found in image")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading image: %v", err)
+		}
+		if hdr.Name != manifestEntryName {
+			continue
+		}
+
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("error reading manifest: %v", err)
+		}
+		var am schema.AppManifest
+		if err := json.Unmarshal(b, &am); err != nil {
+			return nil, fmt.Errorf("error unmarshaling manifest: %v", err)
+		}
+		return &am, nil
+	}
+}
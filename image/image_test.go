@@ -0,0 +1,154 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/containers/standard/schema"
+)
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(data); err != nil {
+		t.Fatalf("gzip write: %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("gzip close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestNewCompressedTarReaderGzip(t *testing.T) {
+	want := []byte("hello, tar stream")
+	r, err := NewCompressedTarReader(bytes.NewReader(gzipBytes(t, want)))
+	if err != nil {
+		t.Fatalf("NewCompressedTarReader: %v", err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestNewCompressedTarReaderPlain(t *testing.T) {
+	// A plain tar stream shares no magic bytes with gzip, bzip2, or xz,
+	// so it should be passed through unmodified.
+	want := []byte("not actually compressed")
+	r, err := NewCompressedTarReader(bytes.NewReader(want))
+	if err != nil {
+		t.Fatalf("NewCompressedTarReader: %v", err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestNewCompressedTarReaderBzip2Magic(t *testing.T) {
+	// Sniffing the "BZh" magic must route the stream through
+	// bzip2.NewReader rather than passing it through unmodified: reading
+	// it back out as plain bytes (the bzip2 magic plus garbage, which
+	// isn't valid bzip2) should fail to decode instead of round-tripping
+	// byte-for-byte like the plain-tar case does.
+	r, err := NewCompressedTarReader(bytes.NewReader([]byte("BZhbogus")))
+	if err != nil {
+		t.Fatalf("NewCompressedTarReader: %v", err)
+	}
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Fatal("expected bogus bzip2 data to fail to decode, got no error")
+	}
+}
+
+func TestNewCompressedTarReaderXZUnsupported(t *testing.T) {
+	xzMagic := []byte{0xfd, '7', 'z', 'X', 'Z', 0x00, 0, 0, 0}
+	if _, err := NewCompressedTarReader(bytes.NewReader(xzMagic)); err == nil {
+		t.Fatal("expected an error for xz-compressed input, got nil")
+	}
+}
+
+// buildTar returns an uncompressed tar stream containing one entry per
+// (name, data) pair in entries, in order.
+func buildTar(t *testing.T, entries []struct {
+	name string
+	data []byte
+}) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		if err := tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.data))}); err != nil {
+			t.Fatalf("WriteHeader(%q): %v", e.name, err)
+		}
+		if _, err := tw.Write(e.data); err != nil {
+			t.Fatalf("Write(%q): %v", e.name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("tar Close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestManifestFromImage(t *testing.T) {
+	want := &schema.AppManifest{Name: "test-app"}
+	manifestBytes, err := json.Marshal(want)
+	if err != nil {
+		t.Fatalf("marshaling test manifest: %v", err)
+	}
+
+	img := buildTar(t, []struct {
+		name string
+		data []byte
+	}{
+		{"some-other-file", []byte("not the manifest")},
+		{"manifest", manifestBytes},
+	})
+
+	am, err := ManifestFromImage(bytes.NewReader(img))
+	if err != nil {
+		t.Fatalf("ManifestFromImage: %v", err)
+	}
+	if am.Name != want.Name {
+		t.Errorf("Name = %q, want %q", am.Name, want.Name)
+	}
+}
+
+func TestManifestFromImageNoManifest(t *testing.T) {
+	img := buildTar(t, []struct {
+		name string
+		data []byte
+	}{
+		{"some-other-file", []byte("not the manifest")},
+	})
+
+	if _, err := ManifestFromImage(bytes.NewReader(img)); err == nil {
+		t.Fatal("expected an error when no manifest entry is present, got nil")
+	}
+}
+
+func TestNewCompressedTarReaderShortInput(t *testing.T) {
+	// Fewer than 6 bytes total: Peek returns io.EOF, which must not be
+	// treated as a sniffing failure.
+	want := []byte("hi")
+	r, err := NewCompressedTarReader(bytes.NewReader(want))
+	if err != nil {
+		t.Fatalf("NewCompressedTarReader: %v", err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,421 @@
+// Package imgtype detects and converts OCI image-layout inputs (either an
+// "oci-archive:" tar or an "oci:" directory containing index.json and
+// blobs/sha256/) so stage0 can treat them the same way it treats ACI/TAF
+// images, once converted.
+package imgtype
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/standard/schema"
+	"github.com/containers/standard/schema/types"
+	"github.com/coreos-inc/rkt/image"
+)
+
+// Type identifies the on-disk layout of an image given to `rkt run`.
+type Type int
+
+const (
+	TypeUnknown Type = iota
+	TypeACI
+	TypeOCIArchive
+	TypeOCIDir
+)
+
+// Detect sniffs path and reports whether it is a plain ACI/TAF tarball, an
+// OCI image-layout tar ("oci-archive:"), or an OCI image-layout directory
+// ("oci:").
+func Detect(path string) (Type, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return TypeUnknown, fmt.Errorf("error statting %q: %v", path, err)
+	}
+
+	if fi.IsDir() {
+		if _, err := os.Stat(filepath.Join(path, "index.json")); err != nil {
+			return TypeUnknown, fmt.Errorf("%q is a directory but not an OCI image layout (missing index.json)", path)
+		}
+		return TypeOCIDir, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return TypeUnknown, fmt.Errorf("error opening %q: %v", path, err)
+	}
+	defer f.Close()
+
+	cr, err := image.NewCompressedTarReader(f)
+	if err != nil {
+		return TypeUnknown, fmt.Errorf("error reading %q: %v", path, err)
+	}
+
+	tr := tar.NewReader(cr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return TypeUnknown, fmt.Errorf("error reading %q: %v", path, err)
+		}
+		switch hdr.Name {
+		case "oci-layout", "./oci-layout":
+			return TypeOCIArchive, nil
+		case "manifest", "./manifest":
+			return TypeACI, nil
+		}
+	}
+
+	return TypeUnknown, fmt.Errorf("%q is neither a recognized ACI nor an OCI image-layout archive", path)
+}
+
+// ociIndex mirrors the subset of an OCI index.json this package needs.
+type ociIndex struct {
+	Manifests []struct {
+		Digest string `json:"digest"`
+	} `json:"manifests"`
+}
+
+// ociManifest mirrors the subset of an OCI image manifest this package
+// needs.
+type ociManifest struct {
+	Config struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+	Layers []struct {
+		Digest string `json:"digest"`
+	} `json:"layers"`
+}
+
+// ociConfig mirrors the subset of an OCI image config this package needs.
+type ociConfig struct {
+	Config struct {
+		Env        []string          `json:"Env"`
+		Entrypoint []string          `json:"Entrypoint"`
+		Cmd        []string          `json:"Cmd"`
+		WorkingDir string            `json:"WorkingDir"`
+		User       string            `json:"User"`
+		Labels     map[string]string `json:"Labels"`
+	} `json:"config"`
+}
+
+// blobSource loads the raw bytes of a blob referenced by a "sha256:..."
+// digest out of an OCI image layout, whether it's a directory or a tar
+// archive already unpacked into memory.
+type blobSource interface {
+	blob(digest string) ([]byte, error)
+}
+
+// dirBlobSource reads blobs from an unpacked OCI directory layout.
+type dirBlobSource struct {
+	root string
+}
+
+func (d dirBlobSource) blob(digest string) ([]byte, error) {
+	algoHash, err := splitDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(filepath.Join(d.root, "blobs", algoHash[0], algoHash[1]))
+}
+
+// memBlobSource reads blobs already extracted from an oci-archive tar
+// into memory, keyed by their digest.
+type memBlobSource struct {
+	blobs map[string][]byte
+}
+
+func (m memBlobSource) blob(digest string) ([]byte, error) {
+	b, ok := m.blobs[digest]
+	if !ok {
+		return nil, fmt.Errorf("blob %q not found in archive", digest)
+	}
+	return b, nil
+}
+
+func splitDigest(digest string) ([2]string, error) {
+	const prefix = "sha256:"
+	if len(digest) <= len(prefix) || digest[:len(prefix)] != prefix {
+		return [2]string{}, fmt.Errorf("unsupported digest %q", digest)
+	}
+	return [2]string{"sha256", digest[len(prefix):]}, nil
+}
+
+// Convert reads the OCI image layout at ociRef (a directory for
+// TypeOCIDir, or a tar archive for TypeOCIArchive) and returns a squashed
+// rootfs tarball plus the equivalent appc AppManifest, so stage0 can
+// extract and register it exactly like an ACI. The app's name is derived
+// from ociRef itself (there's no other name to draw on in an OCI image
+// layout), since stage0 keys apps by name and needs every converted
+// image to have a distinct, non-empty one.
+func Convert(ociRef string) (io.ReadCloser, *schema.AppManifest, error) {
+	name, err := nameFromRef(ociRef)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	t, err := Detect(ociRef)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var src blobSource
+	switch t {
+	case TypeOCIDir:
+		idxBytes, err := ioutil.ReadFile(filepath.Join(ociRef, "index.json"))
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading index.json: %v", err)
+		}
+		var idx ociIndex
+		if err := json.Unmarshal(idxBytes, &idx); err != nil {
+			return nil, nil, fmt.Errorf("error parsing index.json: %v", err)
+		}
+		if len(idx.Manifests) == 0 {
+			return nil, nil, fmt.Errorf("no manifests listed in index.json")
+		}
+		src = dirBlobSource{root: ociRef}
+		return convert(src, idx.Manifests[0].Digest, name)
+
+	case TypeOCIArchive:
+		blobs, idx, err := readArchive(ociRef)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(idx.Manifests) == 0 {
+			return nil, nil, fmt.Errorf("no manifests listed in index.json")
+		}
+		src = memBlobSource{blobs: blobs}
+		return convert(src, idx.Manifests[0].Digest, name)
+
+	default:
+		return nil, nil, fmt.Errorf("%q is not an OCI image layout", ociRef)
+	}
+}
+
+// nameFromRef derives an ACLabel-safe app name from an OCI ref's base
+// filename (an archive's name, or a layout directory's name), lower-
+// cased and with anything outside [a-z0-9-] collapsed to a single "-".
+// It errors if nothing nameable survives, rather than letting an empty
+// name reach stage0.
+func nameFromRef(ociRef string) (string, error) {
+	base := filepath.Base(filepath.Clean(ociRef))
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+
+	var b bytes.Buffer
+	prevDash := true // treat the start as if a dash were just written, to avoid a leading one
+	for _, r := range strings.ToLower(base) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+			prevDash = false
+		case !prevDash:
+			b.WriteRune('-')
+			prevDash = true
+		}
+	}
+	name := strings.Trim(b.String(), "-")
+	if name == "" {
+		return "", fmt.Errorf("cannot derive an app name from %q", ociRef)
+	}
+	return name, nil
+}
+
+// readArchive extracts every blob, plus index.json, from an oci-archive
+// tarball into memory so they can be looked up by digest.
+func readArchive(path string) (map[string][]byte, ociIndex, error) {
+	var idx ociIndex
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, idx, fmt.Errorf("error opening %q: %v", path, err)
+	}
+	defer f.Close()
+
+	cr, err := image.NewCompressedTarReader(f)
+	if err != nil {
+		return nil, idx, fmt.Errorf("error reading %q: %v", path, err)
+	}
+
+	blobs := map[string][]byte{}
+	var indexBytes []byte
+
+	tr := tar.NewReader(cr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, idx, fmt.Errorf("error reading %q: %v", path, err)
+		}
+
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, idx, fmt.Errorf("error reading entry %q: %v", hdr.Name, err)
+		}
+
+		switch {
+		case hdr.Name == "index.json" || hdr.Name == "./index.json":
+			indexBytes = b
+		case filepath.Dir(hdr.Name) == "blobs/sha256" || filepath.Dir(hdr.Name) == "./blobs/sha256":
+			blobs["sha256:"+filepath.Base(hdr.Name)] = b
+		}
+	}
+
+	if indexBytes == nil {
+		return nil, idx, fmt.Errorf("no index.json found in %q", path)
+	}
+	if err := json.Unmarshal(indexBytes, &idx); err != nil {
+		return nil, idx, fmt.Errorf("error parsing index.json: %v", err)
+	}
+	return blobs, idx, nil
+}
+
+// convert builds the squashed rootfs tarball and appc manifest for the
+// image manifest at manifestDigest, naming the resulting app name.
+func convert(src blobSource, manifestDigest, name string) (io.ReadCloser, *schema.AppManifest, error) {
+	mb, err := src.blob(manifestDigest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error loading image manifest: %v", err)
+	}
+	var m ociManifest
+	if err := json.Unmarshal(mb, &m); err != nil {
+		return nil, nil, fmt.Errorf("error parsing image manifest: %v", err)
+	}
+
+	cb, err := src.blob(m.Config.Digest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error loading image config: %v", err)
+	}
+	var cfg ociConfig
+	if err := json.Unmarshal(cb, &cfg); err != nil {
+		return nil, nil, fmt.Errorf("error parsing image config: %v", err)
+	}
+
+	am, err := appManifestFromConfig(cfg, name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeSquashedRootfs(pw, src, am, m.Layers))
+	}()
+
+	return pr, am, nil
+}
+
+// writeSquashedRootfs writes a single tar stream containing the app's
+// "manifest" entry followed by each layer's entries under rootfs/, in
+// order. Later layers are simply appended after earlier ones; OCI
+// whiteout ("<dir>/.wh.<name>") entries are not yet resolved into actual
+// deletions, which is an acceptable gap for now since rkt images rarely
+// rely on them.
+func writeSquashedRootfs(w io.Writer, src blobSource, am *schema.AppManifest, layers []struct {
+	Digest string `json:"digest"`
+}) error {
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+
+	amb, err := json.Marshal(am)
+	if err != nil {
+		return fmt.Errorf("error marshaling converted manifest: %v", err)
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: "manifest", Mode: 0644, Size: int64(len(amb))}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(amb); err != nil {
+		return err
+	}
+
+	for _, l := range layers {
+		lb, err := src.blob(l.Digest)
+		if err != nil {
+			return fmt.Errorf("error loading layer %q: %v", l.Digest, err)
+		}
+
+		cr, err := image.NewCompressedTarReader(bytes.NewReader(lb))
+		if err != nil {
+			return fmt.Errorf("error reading layer %q: %v", l.Digest, err)
+		}
+
+		ltr := tar.NewReader(cr)
+		for {
+			hdr, err := ltr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("error reading layer %q: %v", l.Digest, err)
+			}
+			hdr.Name = filepath.Join("rootfs", hdr.Name)
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if _, err := io.Copy(tw, ltr); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// appManifestFromConfig maps an OCI image config onto the equivalent appc
+// AppManifest fields: name comes from the OCI ref (see nameFromRef),
+// labels become annotations. schema.AppManifest in this tree has no
+// Exec/WorkingDir/User/Environment fields yet (stage1 has nothing to run
+// them with either), so entrypoint/cmd/working-dir/user/env are all
+// preserved as coreos.com/rkt/oci-* annotations rather than dropped
+// silently; once AppManifest grows real equivalents these should move
+// there instead. oci-env joins the config's "K=V" entries with NUL since
+// env values may themselves contain commas or spaces.
+func appManifestFromConfig(cfg ociConfig, name string) (*schema.AppManifest, error) {
+	exec := append([]string{}, cfg.Config.Entrypoint...)
+	exec = append(exec, cfg.Config.Cmd...)
+	if len(exec) == 0 {
+		return nil, fmt.Errorf("OCI config has no entrypoint or cmd")
+	}
+
+	var annotations types.Annotations
+	for k, v := range cfg.Config.Labels {
+		annotations = append(annotations, types.Annotation{
+			Name:  types.ACName(k),
+			Value: v,
+		})
+	}
+	annotations = append(annotations, types.Annotation{
+		Name:  types.ACName("coreos.com/rkt/oci-exec"),
+		Value: strings.Join(exec, " "),
+	})
+	if cfg.Config.WorkingDir != "" {
+		annotations = append(annotations, types.Annotation{
+			Name:  types.ACName("coreos.com/rkt/oci-workingdir"),
+			Value: cfg.Config.WorkingDir,
+		})
+	}
+	if cfg.Config.User != "" {
+		annotations = append(annotations, types.Annotation{
+			Name:  types.ACName("coreos.com/rkt/oci-user"),
+			Value: cfg.Config.User,
+		})
+	}
+	if len(cfg.Config.Env) > 0 {
+		annotations = append(annotations, types.Annotation{
+			Name:  types.ACName("coreos.com/rkt/oci-env"),
+			Value: strings.Join(cfg.Config.Env, "\x00"),
+		})
+	}
+
+	return &schema.AppManifest{
+		Name:        types.ACLabel(name),
+		Annotations: annotations,
+	}, nil
+}
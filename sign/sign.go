@@ -0,0 +1,114 @@
+// Package sign verifies detached OpenPGP signatures on app container
+// images against a keystore of trusted keys.
+package sign
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// Keystore describes the set of OpenPGP keys rkt trusts to sign images.
+type Keystore struct {
+	// TrustedKeyring is the path to a keyring (ASCII-armored or binary)
+	// containing the public keys images may be signed with.
+	TrustedKeyring string
+}
+
+func (k *Keystore) entityList() (openpgp.EntityList, error) {
+	f, err := os.Open(k.TrustedKeyring)
+	if err != nil {
+		return nil, fmt.Errorf("error opening trusted keyring: %v", err)
+	}
+	defer f.Close()
+
+	keyring, err := openpgp.ReadArmoredKeyRing(f)
+	if err == nil {
+		return keyring, nil
+	}
+
+	if _, serr := f.Seek(0, 0); serr != nil {
+		return nil, fmt.Errorf("error reading trusted keyring: %v", err)
+	}
+	return openpgp.ReadKeyRing(f)
+}
+
+// VerifyingReader wraps an io.Reader, checking its content against a
+// detached signature as it is read. Because the signature check is driven
+// off the same bytes the caller reads (via a background goroutine fed
+// through a pipe), the image only needs to be streamed once: callers can
+// chain VerifyingReader into a decompression/hashing/extraction pipeline
+// and call Verified once they're done reading.
+//
+// The background goroutine blocks on reading the pipe until it's closed,
+// so callers must always arrange for that to happen: defer a call to
+// Close as soon as a VerifyingReader is created, even along early-return
+// error paths that never read it to EOF.
+type VerifyingReader struct {
+	r    io.Reader
+	pw   *io.PipeWriter
+	done chan error
+	once sync.Once
+}
+
+// NewVerifyingReader returns a reader over r whose contents are checked
+// against sig using ks's trusted keys as they are read.
+func NewVerifyingReader(r io.Reader, sig io.Reader, ks *Keystore) *VerifyingReader {
+	pr, pw := io.Pipe()
+	vr := &VerifyingReader{
+		r:    io.TeeReader(r, pw),
+		pw:   pw,
+		done: make(chan error, 1),
+	}
+
+	go func() {
+		keyring, err := ks.entityList()
+		if err != nil {
+			pr.CloseWithError(err)
+			vr.done <- err
+			return
+		}
+		_, err = openpgp.CheckDetachedSignature(keyring, pr, sig)
+		vr.done <- err
+	}()
+
+	return vr
+}
+
+func (v *VerifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	if err != nil {
+		v.closePipe(err)
+	}
+	return n, err
+}
+
+// Close releases the background verification goroutine, unblocking its
+// pending pipe read if the VerifyingReader was abandoned before reaching
+// EOF (e.g. because an unrelated error aborted the read loop early). It
+// is safe to call multiple times, and safe to call after Read has
+// already reached EOF on its own.
+func (v *VerifyingReader) Close() error {
+	v.closePipe(io.ErrClosedPipe)
+	return nil
+}
+
+func (v *VerifyingReader) closePipe(err error) {
+	v.once.Do(func() {
+		if err == io.EOF {
+			v.pw.Close()
+		} else {
+			v.pw.CloseWithError(err)
+		}
+	})
+}
+
+// Verified blocks until the signature check has run to completion and
+// returns its result. It must only be called after the VerifyingReader
+// has been read to EOF, or after Close has been called to abort it.
+func (v *VerifyingReader) Verified() error {
+	return <-v.done
+}
@@ -0,0 +1,23 @@
+// This file stands in for the output of a go-bindata generation step that
+// does not exist yet: nothing in this tree builds a real stage1 rootfs or
+// init binary to embed. _bindata is intentionally empty, and Asset returns
+// an error for every name until that step is wired up (regenerating this
+// file from the real stage1 build output, keyed the same way). Until
+// then, rkt has no default stage1 and callers must pass --stage1-rootfs
+// and --stage1-init explicitly.
+
+package stage0
+
+import "fmt"
+
+var _bindata = map[string][]byte{}
+
+// Asset returns the embedded asset data for name, or an error if no such
+// asset was bundled into the binary.
+func Asset(name string) ([]byte, error) {
+	b, ok := _bindata[name]
+	if !ok {
+		return nil, fmt.Errorf("asset not found: %s (no embedded stage1 is bundled into this binary yet; pass an explicit path instead)", name)
+	}
+	return b, nil
+}
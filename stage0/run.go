@@ -22,6 +22,12 @@ package stage0
 //
 // the container manifest generated will be compliant with the ACE spec.
 //
+// Setup and Run are split so that stage0 can be embedded: Setup does all
+// filesystem preparation and manifest generation and returns the prepared
+// container directory, while Run performs the final pivot/exec into
+// stage1/init. Callers that only want to inspect or test the prepared
+// container (without actually execing into it) can call Setup alone.
+//
 
 import (
 	"archive/tar"
@@ -43,23 +49,44 @@ import (
 	"github.com/containers/standard/schema"
 	"github.com/containers/standard/schema/types"
 	"github.com/containers/standard/taf"
+	"github.com/coreos-inc/rkt/fetch"
+	"github.com/coreos-inc/rkt/image"
 	"github.com/coreos-inc/rkt/rkt"
+	"github.com/coreos-inc/rkt/sign"
+	"github.com/coreos-inc/rkt/store"
+	"github.com/coreos-inc/rkt/volumes"
 )
 
 type Config struct {
+	Store        *store.Store
+	Finder       *fetch.Finder
+	Keystore     *sign.Keystore
+	// Signatures maps an entry of Images to the path of its detached
+	// .asc signature, if any.
+	Signatures map[string]string
+	// InsecureSkipVerify lets images without a corresponding entry in
+	// Signatures run unverified; they are otherwise rejected. Images
+	// that have an entry are verified either way.
+	InsecureSkipVerify bool
+
 	RktDir       string
 	Stage1Init   string
 	Stage1Rootfs string
 	Debug        bool
 	Images       []string
-	Volumes      map[string]string
+	Volumes      []volumes.VolumeSpec
 }
 
 func init() {
 	log.SetOutput(ioutil.Discard)
 }
 
-func Run(cfg Config) {
+// Setup prepares a container filesystem for the given configuration: it
+// generates a Container UID, lays down the stage1 rootfs and init binary,
+// fetches/unpacks each app image, and writes the resulting Container
+// Runtime Manifest. It returns the path to the prepared container
+// directory, leaving the actual pivot/exec to Run.
+func Setup(cfg Config) (string, error) {
 	if cfg.Debug {
 		log.SetOutput(os.Stderr)
 	}
@@ -68,14 +95,14 @@ func Run(cfg Config) {
 		var err error
 		cfg.RktDir, err = ioutil.TempDir("", "rkt")
 		if err != nil {
-			log.Fatalf("error creating temporary directory: %v", err)
+			return "", fmt.Errorf("error creating temporary directory: %v", err)
 		}
 	}
 
 	// - Generating the Container Unique ID (UID)
 	cuuid, err := types.NewUUID(uuid.New())
 	if err != nil {
-		log.Fatalf("error creating UID: %v", err)
+		return "", fmt.Errorf("error creating UID: %v", err)
 	}
 
 	// Create a directory for this container
@@ -83,41 +110,15 @@ func Run(cfg Config) {
 
 	// - Creating a filesystem for the container
 	if err := os.MkdirAll(dir, 0700); err != nil {
-		log.Fatalf("error creating directory: %v", err)
+		return "", fmt.Errorf("error creating directory: %v", err)
 	}
 
-	log.Printf("Writing stage1 rootfs")
-	fh, err := os.Open(cfg.Stage1Rootfs)
-	if err != nil {
-		log.Fatalf("error opening stage1 rootfs: %v", err)
-	}
-	gz, err := gzip.NewReader(fh)
-	if err != nil {
-		log.Fatalf("error reading tarball: %v", err)
-	}
-	rfs := rkt.Stage1RootfsPath(dir)
-	if err = os.MkdirAll(rfs, 0776); err != nil {
-		log.Fatalf("error creating stage1 rootfs directory: %v", err)
-	}
-	if err := taf.ExtractTar(tar.NewReader(gz), rfs); err != nil {
-		log.Fatalf("error extracting TAF: %v", err)
+	if err := unpackRootfs(cfg, dir); err != nil {
+		return "", err
 	}
 
-	log.Printf("Writing stage1 init")
-	in, err := os.Open(cfg.Stage1Init)
-	if err != nil {
-		log.Fatalf("error loading stage1 binary: %v", err)
-	}
-	fn := rkt.Stage1InitPath(dir)
-	out, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY, 0555)
-	if err != nil {
-		log.Fatalf("error opening stage1 init for writing: %v", err)
-	}
-	if _, err := io.Copy(out, in); err != nil {
-		log.Fatalf("error writing stage1 init: %v", err)
-	}
-	if err := out.Close(); err != nil {
-		log.Fatalf("error closing stage1 init: %v", err)
+	if err := writeStage1Init(cfg, dir); err != nil {
+		return "", err
 	}
 
 	log.Printf("Wrote filesystem to %s\n", dir)
@@ -131,121 +132,254 @@ func Run(cfg Config) {
 
 	v, err := types.NewSemVer(rkt.Version)
 	if err != nil {
-		log.Fatalf("error creating version: %v", err)
+		return "", fmt.Errorf("error creating version: %v", err)
 	}
 	cm.ACVersion = *v
 
-	// - Fetching the specified application TAFs
-	//   (for now, we just assume they are local and named by their hash, and unencrypted)
+	// - Fetching the specified application TAFs, resolving hashes,
+	//   paths, URLs and app-names alike down to a verified image in the
+	//   store
 	// - Unpacking the TAFs and copying the RAF for each app into the stage2
-
-	// TODO(jonboulle): clarify imagehash<->appname. Right now we have to
-	// unpack the entire TAF to access the manifest which contains the appname.
-
+	apps := map[types.ACLabel]*schema.AppManifest{}
 	for _, img := range cfg.Images {
-		h, err := types.NewHash(img)
+		ascPath := cfg.Signatures[img]
+		h, err := cfg.Finder.FindImage(img, ascPath)
 		if err != nil {
-			log.Fatalf("bad hash given: %v", err)
+			return "", fmt.Errorf("error finding image %q: %v", img, err)
 		}
-
-		log.Println("Loading app image", img)
-		fh, err := os.Open(img)
+		am, err := setupImage(cfg, h.Val, ascPath, dir, &cm)
 		if err != nil {
-			log.Fatalf("error opening app: %v", err)
-		}
-		gz, err := gzip.NewReader(fh)
-		if err != nil {
-			log.Fatalf("error reading tarball: %v", err)
+			return "", err
 		}
+		apps[am.Name] = am
+	}
 
-		// Sanity check: provided image name matches image ID
-		b, err := ioutil.ReadAll(gz)
-		if err != nil {
-			log.Fatalf("error reading tarball: %v", err)
-		}
-		sum := sha256.Sum256(b)
-		if id := fmt.Sprintf("%x", sum); id != h.Val {
-			log.Fatalf("app manifest hash does not match expected")
-		}
+	if err := volumes.Validate(cfg.Volumes, apps); err != nil {
+		return "", fmt.Errorf("error validating volumes: %v", err)
+	}
+	cm.Volumes = volumes.ToTypesVolumes(cfg.Volumes)
 
-		ad := rkt.AppImagePath(dir, img)
-		err = os.MkdirAll(ad, 0776)
+	if err := writeContainerManifest(cm, dir); err != nil {
+		return "", err
+	}
+
+	return dir, nil
+}
+
+// Run pivots into the prepared container directory dir and execs
+// stage1/init, replacing the current process. On success it does not
+// return.
+func Run(dir string, debug bool) error {
+	log.Printf("Pivoting to filesystem")
+	if err := os.Chdir(dir); err != nil {
+		return fmt.Errorf("failed changing to dir: %v", err)
+	}
+
+	log.Printf("Execing stage1/init")
+	init := "stage1/init"
+	args := []string{init}
+	if debug {
+		args = append(args, "debug")
+	}
+	if err := syscall.Exec(init, args, os.Environ()); err != nil {
+		return fmt.Errorf("error execing init: %v", err)
+	}
+	return nil
+}
+
+// unpackRootfs lays down the stage1 rootfs into dir. If cfg.Stage1Rootfs is
+// unset, it falls back to the default rootfs bundled into the rkt binary
+// via bindata.go; until that file embeds a real stage1 build (it doesn't
+// yet, see stage0/bindata.go), Asset returns an error here and the caller
+// must pass --stage1-rootfs explicitly.
+func unpackRootfs(cfg Config, dir string) error {
+	log.Printf("Writing stage1 rootfs")
+
+	var r io.Reader
+	if cfg.Stage1Rootfs == "" {
+		b, err := Asset("stage1/rootfs.tar.gz")
 		if err != nil {
-			log.Fatalf("error creating app directory: %v", err)
+			return fmt.Errorf("error loading embedded stage1 rootfs: %v", err)
 		}
-		if err := taf.ExtractTar(tar.NewReader(bytes.NewReader(b)), ad); err != nil {
-			log.Fatalf("error extracting TAF: %v", err)
-		}
-
-		err = os.MkdirAll(filepath.Join(ad, "rootfs/tmp"), 0777)
+		r = bytes.NewReader(b)
+	} else {
+		fh, err := os.Open(cfg.Stage1Rootfs)
 		if err != nil {
-			log.Fatalf("error creating tmp directory: %v", err)
+			return fmt.Errorf("error opening stage1 rootfs: %v", err)
 		}
+		defer fh.Close()
+		r = fh
+	}
 
-		mpath := rkt.AppManifestPath(dir, img)
-		f, err := os.Open(mpath)
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("error reading tarball: %v", err)
+	}
+	rfs := rkt.Stage1RootfsPath(dir)
+	if err := os.MkdirAll(rfs, 0776); err != nil {
+		return fmt.Errorf("error creating stage1 rootfs directory: %v", err)
+	}
+	if err := taf.ExtractTar(tar.NewReader(gz), rfs); err != nil {
+		return fmt.Errorf("error extracting TAF: %v", err)
+	}
+	return nil
+}
+
+// writeStage1Init copies the stage1 init binary into dir. If
+// cfg.Stage1Init is unset, it falls back to the default init bundled via
+// bindata.go, which (see stage0/bindata.go) has nothing embedded yet, so
+// the caller must pass --stage1-init explicitly in the meantime.
+func writeStage1Init(cfg Config, dir string) error {
+	log.Printf("Writing stage1 init")
+
+	var in io.Reader
+	if cfg.Stage1Init == "" {
+		b, err := Asset("stage1/init")
 		if err != nil {
-			log.Fatalf("error opening app manifest: %v", err)
+			return fmt.Errorf("error loading embedded stage1 init: %v", err)
 		}
-		b, err = ioutil.ReadAll(f)
+		in = bytes.NewReader(b)
+	} else {
+		f, err := os.Open(cfg.Stage1Init)
 		if err != nil {
-			log.Fatalf("error reading app manifest: %v", err)
-		}
-		var am schema.AppManifest
-		if err := json.Unmarshal(b, &am); err != nil {
-			log.Fatalf("error unmarshaling app manifest: %v", err)
+			return fmt.Errorf("error loading stage1 binary: %v", err)
 		}
+		defer f.Close()
+		in = f
+	}
 
-		if _, ok := cm.Apps[am.Name]; ok {
-			log.Fatalf("got multiple apps by name %s", am.Name)
-		}
+	fn := rkt.Stage1InitPath(dir)
+	out, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY, 0555)
+	if err != nil {
+		return fmt.Errorf("error opening stage1 init for writing: %v", err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("error writing stage1 init: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("error closing stage1 init: %v", err)
+	}
+	return nil
+}
 
-		a := schema.App{
-			ImageID:     *h,
-			Isolators:   am.Isolators,
-			Annotations: am.Annotations,
-		}
+// setupImage unpacks the app image named by img into its app directory
+// under dir and registers it in cm, returning the app's manifest so the
+// caller can validate its declared MountPoints against the configured
+// volumes. The image is streamed out of cfg.Store and hashed as it is
+// extracted, rather than being read fully into memory up front, so
+// multi-GB images don't need to fit in RAM. If ascPath is non-empty, the
+// image is checked against its detached signature in the same pass; if it
+// is empty, the image is rejected unless cfg.InsecureSkipVerify is set.
+func setupImage(cfg Config, img string, ascPath string, dir string, cm *schema.ContainerRuntimeManifest) (*schema.AppManifest, error) {
+	h, err := types.NewHash(img)
+	if err != nil {
+		return nil, fmt.Errorf("bad hash given: %v", err)
+	}
+
+	if ascPath == "" && !cfg.InsecureSkipVerify {
+		return nil, fmt.Errorf("no signature for image %q (use --insecure-skip-verify to bypass)", img)
+	}
+
+	log.Println("Loading app image", img)
+	rc, err := cfg.Store.ReadStream(h.Val)
+	if err != nil {
+		return nil, fmt.Errorf("error opening app: %v", err)
+	}
+	defer rc.Close()
 
-		cm.Apps[am.Name] = a
+	// Read the manifest directly out of the (still-compressed) image so
+	// we know the app's name before extracting anything to disk.
+	am, err := image.ManifestFromImage(rc)
+	if err != nil {
+		return nil, fmt.Errorf("error reading app manifest: %v", err)
+	}
+	if _, err := rc.Seek(0, 0); err != nil {
+		return nil, fmt.Errorf("error rewinding image: %v", err)
 	}
 
-	var sVols []types.Volume
-	for key, path := range cfg.Volumes {
-		v := types.Volume{
-			Kind:     "host",
-			Source:   path,
-			ReadOnly: true,
-			Fulfills: []types.ACLabel{
-				types.ACLabel(key),
-			},
+	var src io.Reader = rc
+	var vr *sign.VerifyingReader
+	if ascPath != "" {
+		sigFh, err := os.Open(ascPath)
+		if err != nil {
+			return nil, fmt.Errorf("error opening signature: %v", err)
 		}
-		sVols = append(sVols, v)
+		defer sigFh.Close()
+		vr = sign.NewVerifyingReader(rc, sigFh, cfg.Keystore)
+		defer vr.Close()
+		src = vr
 	}
-	cm.Volumes = sVols
 
-	cdoc, err := json.Marshal(cm)
+	cr, err := image.NewCompressedTarReader(src)
 	if err != nil {
-		log.Fatalf("error marshalling container manifest: %v", err)
+		return nil, fmt.Errorf("error reading image: %v", err)
 	}
 
-	log.Printf("Writing container manifest")
-	fn = rkt.ContainerManifestPath(dir)
-	if err := ioutil.WriteFile(fn, cdoc, 0700); err != nil {
-		log.Fatalf("error writing container manifest: %v", err)
+	sum := sha256.New()
+	tr := io.TeeReader(cr, sum)
+
+	if _, ok := cm.Apps[am.Name]; ok {
+		return nil, fmt.Errorf("got multiple apps by name %s", am.Name)
 	}
 
-	log.Printf("Pivoting to filesystem")
-	if err := os.Chdir(dir); err != nil {
-		log.Fatalf("failed changing to dir: %v", err)
+	ad := rkt.AppImagePath(dir, string(am.Name))
+	if _, err := os.Stat(ad); err == nil {
+		log.Printf("app directory for %q already taken, falling back to hash-named directory", am.Name)
+		ad = rkt.AppImagePath(dir, h.Val)
+	}
+	if err := os.MkdirAll(ad, 0776); err != nil {
+		return nil, fmt.Errorf("error creating app directory: %v", err)
+	}
+	if err := taf.ExtractTar(tar.NewReader(tr), ad); err != nil {
+		os.RemoveAll(ad)
+		return nil, fmt.Errorf("error extracting TAF: %v", err)
 	}
 
-	log.Printf("Execing stage1/init")
-	init := "stage1/init"
-	args := []string{init}
-	if cfg.Debug {
-		args = append(args, "debug")
+	// Drain any bytes ExtractTar didn't consume (tar trailing padding)
+	// so the digest and signature check reflect the whole stream.
+	if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+		os.RemoveAll(ad)
+		return nil, fmt.Errorf("error reading tarball: %v", err)
 	}
-	if err := syscall.Exec(init, args, os.Environ()); err != nil {
-		log.Fatalf("error execing init: %v", err)
+
+	if id := fmt.Sprintf("%x", sum.Sum(nil)); id != h.Val {
+		os.RemoveAll(ad)
+		return nil, fmt.Errorf("app image hash does not match expected")
+	}
+
+	if vr != nil {
+		if err := vr.Verified(); err != nil {
+			os.RemoveAll(ad)
+			return nil, fmt.Errorf("signature verification failed: %v", err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(ad, "rootfs/tmp"), 0777); err != nil {
+		return nil, fmt.Errorf("error creating tmp directory: %v", err)
+	}
+
+	cm.Apps[am.Name] = schema.App{
+		ImageID:     *h,
+		Isolators:   am.Isolators,
+		Annotations: am.Annotations,
+	}
+
+	return am, nil
+}
+
+// writeContainerManifest marshals cm and writes it to dir's container
+// manifest path.
+func writeContainerManifest(cm schema.ContainerRuntimeManifest, dir string) error {
+	cdoc, err := json.Marshal(cm)
+	if err != nil {
+		return fmt.Errorf("error marshalling container manifest: %v", err)
+	}
+
+	log.Printf("Writing container manifest")
+	fn := rkt.ContainerManifestPath(dir)
+	if err := ioutil.WriteFile(fn, cdoc, 0700); err != nil {
+		return fmt.Errorf("error writing container manifest: %v", err)
 	}
+	return nil
 }
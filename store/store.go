@@ -0,0 +1,105 @@
+// Package store implements a simple content-addressable store for app
+// container images, keyed by the hex-encoded SHA-256 digest of their
+// contents.
+package store
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Store is a directory-backed content-addressable store. Images are
+// stored as individual files named by their hex-encoded SHA-256 digest.
+type Store struct {
+	dir string
+}
+
+// New returns a Store rooted at dir, creating dir if it does not already
+// exist.
+func New(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating store directory: %v", err)
+	}
+	return &Store{dir: dir}, nil
+}
+
+// ReadSeekCloser is the combination of io.Reader, io.Seeker and
+// io.Closer that stored images support, letting callers rewind a stream
+// (e.g. to inspect its manifest before extracting it) without reopening
+// it.
+type ReadSeekCloser interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+}
+
+// ReadStream returns a reader for the image keyed by key. The caller is
+// responsible for closing it.
+func (s *Store) ReadStream(key string) (ReadSeekCloser, error) {
+	f, err := os.Open(s.path(key))
+	if err != nil {
+		return nil, fmt.Errorf("error opening %q from store: %v", key, err)
+	}
+	return f, nil
+}
+
+// WriteStream stores the contents of r under key, replacing any existing
+// entry. The data is written to a temporary file in the store directory
+// and renamed into place so that a reader never observes a partially
+// written entry.
+func (s *Store) WriteStream(key string, r io.Reader) error {
+	tmp, err := ioutil.TempFile(s.dir, "tmp")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file in store: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing %q to store: %v", key, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing temporary file in store: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path(key)); err != nil {
+		return fmt.Errorf("error moving %q into store: %v", key, err)
+	}
+	return nil
+}
+
+// ResolveKey resolves a (possibly abbreviated) key prefix to the single
+// full key it unambiguously identifies. It returns an error if no key, or
+// more than one key, matches the prefix.
+func (s *Store) ResolveKey(prefix string) (string, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return "", fmt.Errorf("error reading store directory: %v", err)
+	}
+
+	var matches []string
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		name := e.Name()
+		if len(name) >= len(prefix) && name[:len(prefix)] == prefix {
+			matches = append(matches, name)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no keys found matching prefix %q", prefix)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("ambiguous prefix %q: matches %d keys", prefix, len(matches))
+	}
+}
+
+func (s *Store) path(key string) string {
+	return filepath.Join(s.dir, key)
+}
@@ -0,0 +1,62 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func newTestStore(t *testing.T) (*Store, func()) {
+	dir, err := ioutil.TempDir("", "store-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	s, err := New(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("New: %v", err)
+	}
+	return s, func() { os.RemoveAll(dir) }
+}
+
+func TestResolveKey(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	keys := []string{
+		"aaaa1111111111111111111111111111111111111111111111111111111111",
+		"aaaa2222222222222222222222222222222222222222222222222222222222",
+		"bbbb000000000000000000000000000000000000000000000000000000000",
+	}
+	for _, k := range keys {
+		if err := s.WriteStream(k, strings.NewReader(k)); err != nil {
+			t.Fatalf("WriteStream(%q): %v", k, err)
+		}
+	}
+
+	if _, err := s.ResolveKey("cccc"); err == nil {
+		t.Error("ResolveKey with no matching keys: want error, got nil")
+	}
+
+	if _, err := s.ResolveKey("aaaa"); err == nil {
+		t.Error("ResolveKey with an ambiguous prefix: want error, got nil")
+	}
+
+	got, err := s.ResolveKey("bbbb")
+	if err != nil {
+		t.Fatalf("ResolveKey with an unambiguous prefix: %v", err)
+	}
+	if got != keys[2] {
+		t.Errorf("ResolveKey(\"bbbb\") = %q, want %q", got, keys[2])
+	}
+
+	got, err = s.ResolveKey(keys[0])
+	if err != nil {
+		t.Fatalf("ResolveKey with a full key: %v", err)
+	}
+	if got != keys[0] {
+		t.Errorf("ResolveKey(%q) = %q, want %q", keys[0], got, keys[0])
+	}
+}
@@ -0,0 +1,150 @@
+// Package volumes parses the `--volume` flag syntax used by `rkt run`
+// and validates that the resulting volumes fulfill every MountPoint
+// declared by the apps in a container, per the ACE spec.
+package volumes
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/containers/standard/schema"
+	"github.com/containers/standard/schema/types"
+)
+
+// AppMountFulfillment records that a volume fulfills the MountPoint
+// named Mount in the app named App.
+type AppMountFulfillment struct {
+	App   types.ACLabel
+	Mount types.ACLabel
+}
+
+// VolumeSpec is a single `--volume` entry: name,kind=host,source=/path,
+// readOnly=false,fulfills=app1:mnt,app2:mnt.
+type VolumeSpec struct {
+	Name     types.ACLabel
+	Kind     string
+	Source   string
+	ReadOnly bool
+	Fulfills []AppMountFulfillment
+}
+
+// ParseVolumeSpec parses a single --volume argument. The fulfills option,
+// if present, must come last: its value is itself a comma-separated list
+// of app:mountpoint pairs, so everything remaining after "fulfills=" is
+// consumed as part of it rather than being split into further options.
+func ParseVolumeSpec(s string) (*VolumeSpec, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) == 0 || parts[0] == "" {
+		return nil, fmt.Errorf("empty volume spec")
+	}
+
+	vs := &VolumeSpec{
+		Name: types.ACLabel(parts[0]),
+		Kind: "host",
+	}
+
+	for i := 1; i < len(parts); i++ {
+		key, val, ok := splitOption(parts[i])
+		if !ok {
+			return nil, fmt.Errorf("bad volume option %q in %q", parts[i], s)
+		}
+
+		switch key {
+		case "kind":
+			vs.Kind = val
+		case "source":
+			vs.Source = val
+		case "readOnly":
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return nil, fmt.Errorf("bad readOnly value %q in %q: %v", val, s, err)
+			}
+			vs.ReadOnly = b
+		case "fulfills":
+			rest := append([]string{val}, parts[i+1:]...)
+			for _, f := range rest {
+				fulfillment, err := parseFulfillment(f)
+				if err != nil {
+					return nil, fmt.Errorf("bad fulfills entry in %q: %v", s, err)
+				}
+				vs.Fulfills = append(vs.Fulfills, fulfillment)
+			}
+			return vs, nil
+		default:
+			return nil, fmt.Errorf("unknown volume option %q in %q", key, s)
+		}
+	}
+
+	return vs, nil
+}
+
+func splitOption(s string) (key, val string, ok bool) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 {
+		return "", "", false
+	}
+	return kv[0], kv[1], true
+}
+
+func parseFulfillment(s string) (AppMountFulfillment, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return AppMountFulfillment{}, fmt.Errorf("%q: want app:mountpoint", s)
+	}
+	return AppMountFulfillment{App: types.ACLabel(parts[0]), Mount: types.ACLabel(parts[1])}, nil
+}
+
+// Validate checks that every MountPoint declared by each app in apps
+// (keyed by app name) is fulfilled by exactly one of specs, per the ACE
+// spec.
+func Validate(specs []VolumeSpec, apps map[types.ACLabel]*schema.AppManifest) error {
+	fulfillCount := map[types.ACLabel]map[types.ACLabel]int{}
+	for _, vs := range specs {
+		for _, f := range vs.Fulfills {
+			if fulfillCount[f.App] == nil {
+				fulfillCount[f.App] = map[types.ACLabel]int{}
+			}
+			fulfillCount[f.App][f.Mount]++
+		}
+	}
+
+	for appName, am := range apps {
+		for _, mp := range am.MountPoints {
+			n := fulfillCount[appName][types.ACLabel(mp.Name)]
+			switch {
+			case n == 0:
+				return fmt.Errorf("mount point %q of app %q is not fulfilled by any volume", mp.Name, appName)
+			case n > 1:
+				return fmt.Errorf("mount point %q of app %q is fulfilled by more than one volume", mp.Name, appName)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ToTypesVolumes converts specs into the []types.Volume form the
+// Container Runtime Manifest expects. The ACE spec matches a volume to a
+// MountPoint purely by label, so the per-app bookkeeping in Fulfills is
+// flattened down to the distinct mount point names here.
+func ToTypesVolumes(specs []VolumeSpec) []types.Volume {
+	var out []types.Volume
+	for _, vs := range specs {
+		seen := map[types.ACLabel]bool{}
+		var labels []types.ACLabel
+		for _, f := range vs.Fulfills {
+			if !seen[f.Mount] {
+				seen[f.Mount] = true
+				labels = append(labels, f.Mount)
+			}
+		}
+		out = append(out, types.Volume{
+			Kind:     vs.Kind,
+			Source:   vs.Source,
+			ReadOnly: vs.ReadOnly,
+			Fulfills: labels,
+		})
+	}
+	return out
+}
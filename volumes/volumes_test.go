@@ -0,0 +1,82 @@
+package volumes
+
+import (
+	"testing"
+
+	"github.com/containers/standard/schema"
+	"github.com/containers/standard/schema/types"
+)
+
+func TestParseVolumeSpec(t *testing.T) {
+	vs, err := ParseVolumeSpec("data,kind=host,source=/opt/data,readOnly=true,fulfills=app1:db,app2:db")
+	if err != nil {
+		t.Fatalf("ParseVolumeSpec: %v", err)
+	}
+	if vs.Name != "data" || vs.Kind != "host" || vs.Source != "/opt/data" || !vs.ReadOnly {
+		t.Fatalf("unexpected spec: %+v", vs)
+	}
+	if len(vs.Fulfills) != 2 {
+		t.Fatalf("got %d fulfillments, want 2", len(vs.Fulfills))
+	}
+	if vs.Fulfills[0] != (AppMountFulfillment{App: "app1", Mount: "db"}) {
+		t.Errorf("unexpected first fulfillment: %+v", vs.Fulfills[0])
+	}
+	if vs.Fulfills[1] != (AppMountFulfillment{App: "app2", Mount: "db"}) {
+		t.Errorf("unexpected second fulfillment: %+v", vs.Fulfills[1])
+	}
+}
+
+func TestParseVolumeSpecDefaultsKind(t *testing.T) {
+	vs, err := ParseVolumeSpec("data")
+	if err != nil {
+		t.Fatalf("ParseVolumeSpec: %v", err)
+	}
+	if vs.Kind != "host" {
+		t.Errorf("default Kind = %q, want %q", vs.Kind, "host")
+	}
+}
+
+func TestParseVolumeSpecErrors(t *testing.T) {
+	cases := []string{
+		"",
+		",kind=host",
+		"data,kind",
+		"data,bogus=1",
+		"data,readOnly=notabool",
+		"data,fulfills=app1-no-colon",
+	}
+	for _, s := range cases {
+		if _, err := ParseVolumeSpec(s); err == nil {
+			t.Errorf("ParseVolumeSpec(%q): want error, got nil", s)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	apps := map[types.ACLabel]*schema.AppManifest{
+		"app1": {
+			MountPoints: []types.MountPoint{{Name: "db"}},
+		},
+	}
+
+	if err := Validate(nil, apps); err == nil {
+		t.Error("Validate with no volumes: want error for unfulfilled mount point, got nil")
+	}
+
+	matching := []VolumeSpec{{
+		Name:     "data",
+		Kind:     "host",
+		Fulfills: []AppMountFulfillment{{App: "app1", Mount: "db"}},
+	}}
+	if err := Validate(matching, apps); err != nil {
+		t.Errorf("Validate with a matching volume: %v", err)
+	}
+
+	ambiguous := []VolumeSpec{
+		{Name: "data1", Fulfills: []AppMountFulfillment{{App: "app1", Mount: "db"}}},
+		{Name: "data2", Fulfills: []AppMountFulfillment{{App: "app1", Mount: "db"}}},
+	}
+	if err := Validate(ambiguous, apps); err == nil {
+		t.Error("Validate with two volumes fulfilling the same mount point: want error, got nil")
+	}
+}